@@ -0,0 +1,256 @@
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+// alertmanagerMatcher mirrors Alertmanager v2's labelMatcher model, used both
+// by /api/v2/silences and as the matcher set injected on silence creation.
+//
+// IsEqual is a *bool because Alertmanager's v2 API treats it as optional
+// with a default of true: a matcher whose JSON omits isEqual is still an
+// equality matcher, not a negative one.
+type alertmanagerMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+// isEqual reports the matcher's effective isEqual value, defaulting to true
+// when the field was omitted.
+func (m alertmanagerMatcher) isEqual() bool {
+	return m.IsEqual == nil || *m.IsEqual
+}
+
+func equalMatcher(name, value string) alertmanagerMatcher {
+	t := true
+	return alertmanagerMatcher{Name: name, Value: value, IsRegex: false, IsEqual: &t}
+}
+
+// silenceStatus mirrors Alertmanager's silenceStatus.
+type silenceStatus struct {
+	State string `json:"state"`
+}
+
+// silence mirrors the fields of Alertmanager's gettableSilence that the
+// proxy needs to inspect or mutate; everything else round-trips unchanged.
+type silence struct {
+	ID        string                `json:"id,omitempty"`
+	Matchers  []alertmanagerMatcher `json:"matchers"`
+	StartsAt  time.Time             `json:"startsAt"`
+	EndsAt    time.Time             `json:"endsAt"`
+	UpdatedAt time.Time             `json:"updatedAt,omitempty"`
+	CreatedBy string                `json:"createdBy"`
+	Comment   string                `json:"comment"`
+	Status    *silenceStatus        `json:"status,omitempty"`
+}
+
+// amAlert mirrors the fields of Alertmanager's gettableAlert that the proxy
+// needs to filter on; Status/Receivers are passed through untouched.
+type amAlert struct {
+	Labels       labels.Labels   `json:"labels"`
+	Annotations  labels.Labels   `json:"annotations,omitempty"`
+	StartsAt     *time.Time      `json:"startsAt,omitempty"`
+	EndsAt       *time.Time      `json:"endsAt,omitempty"`
+	UpdatedAt    *time.Time      `json:"updatedAt,omitempty"`
+	GeneratorURL string          `json:"generatorURL,omitempty"`
+	Fingerprint  string          `json:"fingerprint,omitempty"`
+	Status       json.RawMessage `json:"status,omitempty"`
+	Receivers    json.RawMessage `json:"receivers,omitempty"`
+}
+
+// matchersHaveLabel reports whether matchers contains an exact, non-regex
+// equality matcher for label=lvalue.
+func matchersHaveLabel(matchers []alertmanagerMatcher, label, lvalue string) bool {
+	for _, m := range matchers {
+		if m.Name == label && m.Value == lvalue && !m.IsRegex && m.isEqual() {
+			return true
+		}
+	}
+	return false
+}
+
+// alertmanagerResponseModifier adapts a filter over a raw JSON body into an
+// http Response modifier. Unlike Prometheus, Alertmanager's v2 API does not
+// wrap results in a {"status":...,"data":...} envelope, so this can't reuse
+// apiResponseModifier.
+func alertmanagerResponseModifier(modifier func(*http.Request, []byte) ([]byte, error)) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			// Pass non-200 responses as-is.
+			return nil
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return errors.Wrap(err, "can't read alertmanager response")
+		}
+
+		out, err := modifier(resp.Request, body)
+		if err != nil {
+			return err
+		}
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(out))
+		resp.Header["Content-Length"] = []string{fmt.Sprint(len(out))}
+
+		return nil
+	}
+}
+
+// silences filters the result of GET /api/v2/silences down to silences
+// whose matcher set pins them to the tenant's label value.
+func (r *routes) silences(req *http.Request, body []byte) ([]byte, error) {
+	var silences []*silence
+	if err := json.Unmarshal(body, &silences); err != nil {
+		return nil, errors.Wrap(err, "can't decode silences")
+	}
+
+	lvalue := mustLabelValue(req.Context())
+	filtered := []*silence{}
+	for _, s := range silences {
+		if matchersHaveLabel(s.Matchers, r.label, lvalue) {
+			filtered = append(filtered, s)
+		}
+	}
+
+	return json.Marshal(filtered)
+}
+
+// silence authorizes the result of GET /api/v2/silence/{id}, rejecting it
+// if the silence's matcher set does not pin it to the tenant's label value.
+func (r *routes) silence(req *http.Request, body []byte) ([]byte, error) {
+	var s silence
+	if err := json.Unmarshal(body, &s); err != nil {
+		return nil, errors.Wrap(err, "can't decode silence")
+	}
+
+	lvalue := mustLabelValue(req.Context())
+	if !matchersHaveLabel(s.Matchers, r.label, lvalue) {
+		return nil, errors.Errorf("silence %q does not belong to this tenant", s.ID)
+	}
+
+	return body, nil
+}
+
+// alertsV2 filters the result of GET /api/v2/alerts down to alerts carrying
+// the tenant's label value, mirroring routes.alerts for the v1 API.
+func (r *routes) alertsV2(req *http.Request, body []byte) ([]byte, error) {
+	var alerts []*amAlert
+	if err := json.Unmarshal(body, &alerts); err != nil {
+		return nil, errors.Wrap(err, "can't decode alerts")
+	}
+
+	lvalue := mustLabelValue(req.Context())
+	filtered := []*amAlert{}
+	for _, a := range alerts {
+		for _, lbl := range a.Labels {
+			if lbl.Name == r.label && lbl.Value == lvalue {
+				filtered = append(filtered, a)
+				break
+			}
+		}
+	}
+
+	return json.Marshal(filtered)
+}
+
+// enforceSilenceMatcher rewrites the body of a POST /api/v2/silences request
+// so that the resulting silence always carries an exact-equality matcher for
+// the tenant's label value. A matcher on that label supplied by the caller
+// is only accepted if it already matches; anything else is rejected so a
+// tenant can't silence alerts belonging to another tenant.
+func enforceSilenceMatcher(label string) func(*http.Request) error {
+	return func(req *http.Request) error {
+		lvalue := mustLabelValue(req.Context())
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return errors.Wrap(err, "can't read request body")
+		}
+		req.Body.Close()
+
+		var s silence
+		if err := json.Unmarshal(body, &s); err != nil {
+			return errors.Wrap(err, "can't decode silence")
+		}
+
+		matchers := make([]alertmanagerMatcher, 0, len(s.Matchers)+1)
+		for _, m := range s.Matchers {
+			if m.Name == label {
+				if m.Value != lvalue || m.IsRegex || !m.isEqual() {
+					return errors.Errorf("matcher on label %q conflicts with the tenant's value %q", label, lvalue)
+				}
+				continue
+			}
+			matchers = append(matchers, m)
+		}
+		matchers = append(matchers, equalMatcher(label, lvalue))
+		s.Matchers = matchers
+
+		out, err := json.Marshal(s)
+		if err != nil {
+			return errors.Wrap(err, "can't encode silence")
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(out))
+		req.ContentLength = int64(len(out))
+
+		return nil
+	}
+}
+
+// authorizeSilenceDeletion rejects a DELETE /api/v2/silence/{id} unless the
+// silence being deleted carries a matcher for the tenant's label value. The
+// delete request itself carries no label information, so the silence is
+// re-fetched from upstream to authorize it.
+func (r *routes) authorizeSilenceDeletion(req *http.Request) error {
+	id := path.Base(req.URL.Path)
+
+	u := *r.upstream
+	u.Path = path.Join(u.Path, "/api/v2/silence", id)
+
+	getReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "can't build silence lookup request")
+	}
+	copyRequestHeaders(getReq, req)
+
+	resp, err := selfRequestClient.Do(getReq)
+	if err != nil {
+		return errors.Wrap(err, "can't fetch silence")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("can't fetch silence %q: unexpected status code %d", id, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "can't read silence")
+	}
+
+	var s silence
+	if err := json.Unmarshal(body, &s); err != nil {
+		return errors.Wrap(err, "can't decode silence")
+	}
+
+	lvalue := mustLabelValue(req.Context())
+	if !matchersHaveLabel(s.Matchers, r.label, lvalue) {
+		return errors.Errorf("silence %q does not belong to this tenant", id)
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package injectproxy
+
+import "testing"
+
+func TestMatchersHaveLabelDefaultsIsEqualToTrue(t *testing.T) {
+	matchers := []alertmanagerMatcher{
+		{Name: "namespace", Value: "tenant-a", IsRegex: false},
+	}
+
+	if !matchersHaveLabel(matchers, "namespace", "tenant-a") {
+		t.Fatal("expected a matcher omitting isEqual to default to an equality matcher")
+	}
+}
+
+func TestMatchersHaveLabelExplicitIsEqualFalse(t *testing.T) {
+	no := false
+	matchers := []alertmanagerMatcher{
+		{Name: "namespace", Value: "tenant-a", IsRegex: false, IsEqual: &no},
+	}
+
+	if matchersHaveLabel(matchers, "namespace", "tenant-a") {
+		t.Fatal("expected an explicit isEqual:false matcher not to count as an equality matcher")
+	}
+}
+
+func TestEqualMatcherIsEqualToTrue(t *testing.T) {
+	m := equalMatcher("namespace", "tenant-a")
+	if m.IsEqual == nil || !*m.IsEqual {
+		t.Fatal("expected equalMatcher to produce an explicit isEqual:true matcher")
+	}
+}
@@ -0,0 +1,136 @@
+package injectproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// targetMetadata mirrors the entries returned by /api/v1/targets/metadata.
+type targetMetadata struct {
+	Target     map[string]string `json:"target"`
+	MetricName string            `json:"metric,omitempty"`
+	Type       string            `json:"type"`
+	Help       string            `json:"help"`
+	Unit       string            `json:"unit"`
+}
+
+// metricMetadata mirrors a single entry of the per-metric list returned by
+// /api/v1/metadata.
+type metricMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// targetsMetadata filters the result of /api/v1/targets/metadata down to
+// targets whose labelset carries the tenant's label value.
+func (r *routes) targetsMetadata(resp *apiResponse) error {
+	var targets []*targetMetadata
+	if err := json.Unmarshal([]byte(resp.Data), &targets); err != nil {
+		return errors.Wrap(err, "can't decode targets metadata")
+	}
+
+	lvalue := mustLabelValue(resp.Context())
+	filtered := []*targetMetadata{}
+	for _, t := range targets {
+		if t.Target[r.label] == lvalue {
+			filtered = append(filtered, t)
+		}
+	}
+
+	if hidden := len(targets) - len(filtered); hidden > 0 {
+		resp.addWarning(fmt.Sprintf("%d targets hidden by label enforcement", hidden))
+	}
+
+	if err := resp.setData(filtered); err != nil {
+		return errors.Wrap(err, "can't set data")
+	}
+
+	return nil
+}
+
+// metadata filters the result of /api/v1/metadata down to metric names
+// visible to the tenant, i.e. names for which a series with the tenant's
+// label value exists upstream.
+func (r *routes) metadata(resp *apiResponse) error {
+	var data map[string][]metricMetadata
+	if err := json.Unmarshal([]byte(resp.Data), &data); err != nil {
+		return errors.Wrap(err, "can't decode metadata")
+	}
+
+	lvalue := mustLabelValue(resp.Context())
+	names, err := r.tenantMetricNames(resp.Context(), resp.Header(), lvalue)
+	if err != nil {
+		return errors.Wrap(err, "can't resolve tenant's metric names")
+	}
+
+	filtered := map[string][]metricMetadata{}
+	for name, entries := range data {
+		if _, ok := names[name]; ok {
+			filtered[name] = entries
+		}
+	}
+
+	if hidden := len(data) - len(filtered); hidden > 0 {
+		resp.addWarning(fmt.Sprintf("%d metric names hidden by label enforcement", hidden))
+	}
+
+	if err := resp.setData(filtered); err != nil {
+		return errors.Wrap(err, "can't set data")
+	}
+
+	return nil
+}
+
+// tenantMetricNames resolves the set of metric names visible to the tenant
+// identified by lvalue by asking upstream for the series carrying the
+// tenant's label value, and collecting their __name__ labels. header carries
+// the inbound request's headers (e.g. Authorization) so the sub-request is
+// authorized the same way the original request was.
+func (r *routes) tenantMetricNames(ctx context.Context, header http.Header, lvalue string) (map[string]struct{}, error) {
+	u := *r.upstream
+	u.Path = path.Join(u.Path, "/api/v1/series")
+	u.RawQuery = url.Values{
+		"match[]": {fmt.Sprintf("{%s=%q}", r.label, lvalue)},
+	}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't build series request")
+	}
+	for name, values := range header {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+
+	hresp, err := selfRequestClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't fetch series")
+	}
+
+	apir, err := getAPIResponse(hresp)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode series response")
+	}
+
+	var series []map[string]string
+	if err := json.Unmarshal([]byte(apir.Data), &series); err != nil {
+		return nil, errors.Wrap(err, "can't decode series data")
+	}
+
+	names := make(map[string]struct{}, len(series))
+	for _, s := range series {
+		if name, ok := s["__name__"]; ok {
+			names[name] = struct{}{}
+		}
+	}
+
+	return names, nil
+}
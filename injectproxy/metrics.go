@@ -0,0 +1,25 @@
+package injectproxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	responseModifierErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "prom_label_proxy_response_modifier_errors_total",
+		Help: "Total number of errors encountered while modifying an upstream response.",
+	})
+
+	warningsInjectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "prom_label_proxy_warnings_injected_total",
+		Help: "Total number of tenant-scoped warnings injected into upstream responses by label enforcement.",
+	})
+)
+
+// addWarning appends a tenant-scoped warning to the response so that
+// clients can distinguish "empty because filtered" from "empty upstream".
+func (a *apiResponse) addWarning(warning string) {
+	a.Warnings = append(a.Warnings, warning)
+	warningsInjectedTotal.Inc()
+}
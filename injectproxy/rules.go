@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -20,7 +22,9 @@ type apiResponse struct {
 	Error     string          `json:"error,omitempty"`
 	Warnings  []string        `json:"warnings,omitempty"`
 
-	ctx context.Context
+	ctx    context.Context
+	query  url.Values
+	header http.Header
 }
 
 func getAPIResponse(resp *http.Response) (*apiResponse, error) {
@@ -40,6 +44,8 @@ func getAPIResponse(resp *http.Response) (*apiResponse, error) {
 	}
 
 	apir.ctx = resp.Request.Context()
+	apir.query = resp.Request.URL.Query()
+	apir.header = resp.Request.Header
 
 	return &apir, nil
 }
@@ -57,6 +63,21 @@ func (a *apiResponse) Context() context.Context {
 	return a.ctx
 }
 
+// Query returns the query parameters of the request that produced this
+// response, so that modifiers can honor upstream filter parameters (e.g.
+// /api/v1/rules's type, rule_name[], rule_group[] and file[]).
+func (a *apiResponse) Query() url.Values {
+	return a.query
+}
+
+// Header returns the headers of the request that produced this response,
+// so that modifiers that need to make their own authorized upstream calls
+// (e.g. resolving a tenant's visible metric names) can forward the
+// credentials the original request carried.
+func (a *apiResponse) Header() http.Header {
+	return a.header
+}
+
 type rulesData struct {
 	RuleGroups []*ruleGroup `json:"groups"`
 }
@@ -159,16 +180,24 @@ type alert struct {
 func apiResponseModifier(modifier func(*apiResponse) error) func(*http.Response) error {
 	return func(resp *http.Response) error {
 		if resp.StatusCode != http.StatusOK {
-			// Pass non-200 responses as-is.
+			// Still re-emit a Prometheus-style JSON error as a well-formed
+			// error body rather than passing the raw upstream payload
+			// through untouched; any other error body passes through as-is.
+			if err := rewriteJSONError(resp); err != nil {
+				responseModifierErrorsTotal.Inc()
+				return errors.Wrap(err, "can't rewrite API error response")
+			}
 			return nil
 		}
 		apir, err := getAPIResponse(resp)
 		if err != nil {
+			responseModifierErrorsTotal.Inc()
 			return errors.Wrap(err, "can't decode API response")
 		}
 
 		err = modifier(apir)
 		if err != nil {
+			responseModifierErrorsTotal.Inc()
 			return err
 		}
 
@@ -183,6 +212,150 @@ func apiResponseModifier(modifier func(*apiResponse) error) func(*http.Response)
 	}
 }
 
+// rewriteJSONError re-emits a non-200 upstream response as a well-formed
+// Prometheus-style JSON error body, preserving the original errorType,
+// error message and HTTP status code. Non-JSON error bodies (e.g. plain
+// text from a reverse proxy in front of Prometheus) are passed through
+// unchanged.
+func rewriteJSONError(resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var apir apiResponse
+	if err := json.Unmarshal(body, &apir); err != nil || apir.Status != "error" {
+		// Not a well-formed Prometheus error payload; leave it as-is.
+		return nil
+	}
+
+	out, err := json.Marshal(&apiResponse{
+		Status:    "error",
+		ErrorType: apir.ErrorType,
+		Error:     apir.Error,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(out))
+	resp.Header["Content-Length"] = []string{fmt.Sprint(len(out))}
+
+	return nil
+}
+
+// rulesFilter holds the standard Prometheus /api/v1/rules query parameters
+// that select which rules are returned, independent of tenancy.
+type rulesFilter struct {
+	typ        string
+	ruleNames  map[string]struct{}
+	ruleGroups map[string]struct{}
+	files      map[string]struct{}
+}
+
+func newRulesFilter(values url.Values) rulesFilter {
+	return rulesFilter{
+		typ:        values.Get("type"),
+		ruleNames:  toSet(values["rule_name[]"]),
+		ruleGroups: toSet(values["rule_group[]"]),
+		files:      toSet(values["file[]"]),
+	}
+}
+
+func toSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// matchesRuleGroup reports whether rg passes the file[] and rule_group[]
+// filters. An empty filter matches everything.
+func (f rulesFilter) matchesRuleGroup(rg *ruleGroup) bool {
+	if len(f.files) > 0 {
+		if _, ok := f.files[rg.File]; !ok {
+			return false
+		}
+	}
+	if len(f.ruleGroups) > 0 {
+		if _, ok := f.ruleGroups[rg.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesRule reports whether the rule passes the type and rule_name[]
+// filters. An empty filter matches everything.
+func (f rulesFilter) matchesRule(rule rule) bool {
+	switch f.typ {
+	case "alert":
+		if rule.alertingRule == nil {
+			return false
+		}
+	case "record":
+		if rule.recordingRule == nil {
+			return false
+		}
+	}
+
+	if len(f.ruleNames) > 0 {
+		var name string
+		if rule.alertingRule != nil {
+			name = rule.alertingRule.Name
+		} else {
+			name = rule.recordingRule.Name
+		}
+		if _, ok := f.ruleNames[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ruleBelongsToTenant reports whether rule should be visible to the tenant
+// identified by lvalue, and for alerting rules narrows rule.Alerts down to
+// only the alerts belonging to that tenant.
+//
+// The tenant label is usually injected by relabeling at evaluation time, so
+// it shows up on the generated alerts rather than on the rule itself; a
+// recording rule has no such generated instances and keeps relying on its
+// own labels.
+func (r *routes) ruleBelongsToTenant(rl rule, lvalue string) bool {
+	if rl.recordingRule != nil {
+		for _, lbl := range rl.Labels() {
+			if lbl.Name == r.label && lbl.Value == lvalue {
+				return true
+			}
+		}
+		return false
+	}
+
+	var alerts []*alert
+	for _, a := range rl.alertingRule.Alerts {
+		for _, lbl := range a.Labels {
+			if lbl.Name == r.label && lbl.Value == lvalue {
+				alerts = append(alerts, a)
+				break
+			}
+		}
+	}
+	if len(alerts) == 0 {
+		return false
+	}
+	rl.alertingRule.Alerts = alerts
+
+	return true
+}
+
 func (r *routes) rules(resp *apiResponse) error {
 	var rgs rulesData
 	if err := json.Unmarshal([]byte(resp.Data), &rgs); err != nil {
@@ -190,21 +363,49 @@ func (r *routes) rules(resp *apiResponse) error {
 	}
 
 	lvalue := mustLabelValue(resp.Context())
+	filter := newRulesFilter(resp.Query())
+
 	filtered := []*ruleGroup{}
+	hiddenByTenant := 0
 	for _, rg := range rgs.RuleGroups {
+		// Tenant-label filter first: a tenant must never see another
+		// tenant's groups, even by naming them in rule_group[]/file[].
 		var rules []rule
 		for _, rule := range rg.Rules {
-			for _, lbl := range rule.Labels() {
-				if lbl.Name == r.label && lbl.Value == lvalue {
-					rules = append(rules, rule)
-					break
-				}
+			if !r.ruleBelongsToTenant(rule, lvalue) {
+				continue
 			}
+			rules = append(rules, rule)
 		}
-		if len(rules) > 0 {
-			rg.Rules = rules
-			filtered = append(filtered, rg)
+		if len(rules) == 0 {
+			hiddenByTenant++
+			continue
+		}
+
+		if !filter.matchesRuleGroup(rg) {
+			continue
 		}
+
+		var matched []rule
+		for _, rule := range rules {
+			if filter.matchesRule(rule) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		rg.Rules = matched
+		filtered = append(filtered, rg)
+	}
+
+	// Only groups removed by the tenant-label step are reported: groups
+	// dropped by the caller's own type/file[]/rule_group[] filters are not
+	// "hidden by label enforcement" and would be misleading to report as
+	// such.
+	if hiddenByTenant > 0 {
+		resp.addWarning(fmt.Sprintf("%d rule groups hidden by label enforcement", hiddenByTenant))
 	}
 
 	if err := resp.setData(&rulesData{RuleGroups: filtered}); err != nil {
@@ -231,6 +432,10 @@ func (r *routes) alerts(resp *apiResponse) error {
 		}
 	}
 
+	if hidden := len(data.Alerts) - len(filtered); hidden > 0 {
+		resp.addWarning(fmt.Sprintf("%d alerts hidden by label enforcement", hidden))
+	}
+
 	if err := resp.setData(&alertsData{Alerts: filtered}); err != nil {
 		return errors.Wrap(err, "can't set data")
 	}
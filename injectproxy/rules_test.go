@@ -0,0 +1,233 @@
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestRulesFilterMatchesRuleGroup(t *testing.T) {
+	rg := &ruleGroup{Name: "group-a", File: "file-a.yaml"}
+
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		want   bool
+	}{
+		{"no filter", url.Values{}, true},
+		{"matching file", url.Values{"file[]": {"file-a.yaml"}}, true},
+		{"non-matching file", url.Values{"file[]": {"file-b.yaml"}}, false},
+		{"matching group", url.Values{"rule_group[]": {"group-a"}}, true},
+		{"non-matching group", url.Values{"rule_group[]": {"group-b"}}, false},
+		{"matching file and group", url.Values{"file[]": {"file-a.yaml"}, "rule_group[]": {"group-a"}}, true},
+		{"matching file, non-matching group", url.Values{"file[]": {"file-a.yaml"}, "rule_group[]": {"group-b"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := newRulesFilter(tc.values)
+			if got := filter.matchesRuleGroup(rg); got != tc.want {
+				t.Errorf("matchesRuleGroup() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRulesFilterMatchesRule(t *testing.T) {
+	alerting := rule{alertingRule: &alertingRule{Name: "AlertA", Type: "alerting"}}
+	recording := rule{recordingRule: &recordingRule{Name: "record:a", Type: "recording"}}
+
+	for _, tc := range []struct {
+		name   string
+		values url.Values
+		rule   rule
+		want   bool
+	}{
+		{"no filter, alerting", url.Values{}, alerting, true},
+		{"no filter, recording", url.Values{}, recording, true},
+		{"type=alert, alerting", url.Values{"type": {"alert"}}, alerting, true},
+		{"type=alert, recording", url.Values{"type": {"alert"}}, recording, false},
+		{"type=record, recording", url.Values{"type": {"record"}}, recording, true},
+		{"type=record, alerting", url.Values{"type": {"record"}}, alerting, false},
+		{"matching rule_name[]", url.Values{"rule_name[]": {"AlertA"}}, alerting, true},
+		{"non-matching rule_name[]", url.Values{"rule_name[]": {"AlertB"}}, alerting, false},
+		{"type and rule_name[] both match", url.Values{"type": {"alert"}, "rule_name[]": {"AlertA"}}, alerting, true},
+		{"type matches, rule_name[] doesn't", url.Values{"type": {"alert"}, "rule_name[]": {"AlertB"}}, alerting, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filter := newRulesFilter(tc.values)
+			if got := filter.matchesRule(tc.rule); got != tc.want {
+				t.Errorf("matchesRule() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRulesFilterDropsEmptyGroups(t *testing.T) {
+	rgs := []*ruleGroup{
+		{
+			Name: "group-a",
+			File: "a.yaml",
+			Rules: []rule{
+				{alertingRule: &alertingRule{Name: "AlertA", Type: "alerting"}},
+				{recordingRule: &recordingRule{Name: "record:a", Type: "recording"}},
+			},
+		},
+		{
+			Name: "group-b",
+			File: "b.yaml",
+			Rules: []rule{
+				{recordingRule: &recordingRule{Name: "record:b", Type: "recording"}},
+			},
+		},
+	}
+
+	filter := newRulesFilter(url.Values{"type": {"alert"}})
+
+	var filtered []*ruleGroup
+	for _, rg := range rgs {
+		if !filter.matchesRuleGroup(rg) {
+			continue
+		}
+		var matched []rule
+		for _, rule := range rg.Rules {
+			if filter.matchesRule(rule) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		rg.Rules = matched
+		filtered = append(filtered, rg)
+	}
+
+	if len(filtered) != 1 {
+		t.Fatalf("expected group-b to be dropped (no alerting rules), got %d groups", len(filtered))
+	}
+	if filtered[0].Name != "group-a" {
+		t.Fatalf("expected group-a, got %q", filtered[0].Name)
+	}
+	if len(filtered[0].Rules) != 1 || filtered[0].Rules[0].alertingRule == nil {
+		t.Fatalf("expected only the alerting rule to survive, got %+v", filtered[0].Rules)
+	}
+}
+
+func TestRuleBelongsToTenantAlertingRuleMatchesOnGeneratedAlerts(t *testing.T) {
+	r := &routes{label: "namespace"}
+
+	rl := rule{
+		alertingRule: &alertingRule{
+			Name: "AlertA",
+			Type: "alerting",
+			Alerts: []*alert{
+				{Labels: labels.Labels{{Name: "namespace", Value: "tenant-a"}}},
+				{Labels: labels.Labels{{Name: "namespace", Value: "tenant-b"}}},
+			},
+		},
+	}
+
+	if !r.ruleBelongsToTenant(rl, "tenant-a") {
+		t.Fatal("expected rule to belong to tenant-a since one of its alerts carries that label")
+	}
+	if len(rl.alertingRule.Alerts) != 1 || rl.alertingRule.Alerts[0].Labels.Get("namespace") != "tenant-a" {
+		t.Fatalf("expected Alerts to be narrowed to tenant-a's alert, got %+v", rl.alertingRule.Alerts)
+	}
+}
+
+func TestRuleBelongsToTenantAlertingRuleNoMatchingAlerts(t *testing.T) {
+	r := &routes{label: "namespace"}
+
+	rl := rule{
+		alertingRule: &alertingRule{
+			Name: "AlertA",
+			Type: "alerting",
+			Alerts: []*alert{
+				{Labels: labels.Labels{{Name: "namespace", Value: "tenant-b"}}},
+			},
+		},
+	}
+
+	if r.ruleBelongsToTenant(rl, "tenant-a") {
+		t.Fatal("expected rule not to belong to tenant-a: none of its alerts carry that label")
+	}
+}
+
+func TestRuleBelongsToTenantRecordingRuleMatchesOwnLabels(t *testing.T) {
+	r := &routes{label: "namespace"}
+
+	rl := rule{
+		recordingRule: &recordingRule{
+			Name:   "record:a",
+			Type:   "recording",
+			Labels: labels.Labels{{Name: "namespace", Value: "tenant-a"}},
+		},
+	}
+
+	if !r.ruleBelongsToTenant(rl, "tenant-a") {
+		t.Fatal("expected recording rule to belong to tenant-a based on its own labels")
+	}
+	if r.ruleBelongsToTenant(rl, "tenant-b") {
+		t.Fatal("expected recording rule not to belong to tenant-b")
+	}
+}
+
+func TestRewriteJSONErrorPreservesErrorTypeAndMessage(t *testing.T) {
+	body := `{"status":"error","errorType":"bad_data","error":"invalid parameter \"match[]\""}`
+
+	resp := &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+	}
+
+	if err := rewriteJSONError(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var apir apiResponse
+	if err := json.Unmarshal(out, &apir); err != nil {
+		t.Fatal(err)
+	}
+
+	if apir.Status != "error" || apir.ErrorType != "bad_data" || apir.Error != `invalid parameter "match[]"` {
+		t.Fatalf("unexpected rewritten error body: %+v", apir)
+	}
+}
+
+func TestRewriteJSONErrorPassesThroughNonJSON(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString("bad gateway")),
+	}
+
+	if err := rewriteJSONError(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "bad gateway" {
+		t.Fatalf("expected non-JSON body to pass through unchanged, got %q", out)
+	}
+}
+
+func TestAddWarning(t *testing.T) {
+	apir := &apiResponse{}
+	apir.addWarning("3 rule groups hidden by label enforcement")
+
+	if len(apir.Warnings) != 1 || apir.Warnings[0] != "3 rule groups hidden by label enforcement" {
+		t.Fatalf("unexpected warnings: %v", apir.Warnings)
+	}
+}
@@ -0,0 +1,270 @@
+package injectproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+// streamingThreshold is the upstream Content-Length above which
+// apiResponseModifier switches from the fully-buffered codec to the
+// streaming one below, to avoid holding two full copies of a very large
+// /api/v1/rules response in memory at once. Prometheus commonly serves
+// large rules responses with chunked transfer-encoding, in which case
+// Content-Length is unknown (-1); that case is treated the same as "above
+// the threshold", since an upstream choosing to stream its own response is
+// itself a signal that the body is large. Only a Content-Length we can
+// positively trust to be small (0 <= Content-Length < streamingThreshold)
+// falls back to the buffered codec.
+//
+// NOTE: only /api/v1/rules is covered by the streaming codec below.
+// /api/v1/series, which would benefit the same way, still goes through the
+// buffered path.
+const streamingThreshold = 4 << 20 // 4MiB
+
+// streamingRulesModifier is the streaming counterpart of
+// apiResponseModifier+routes.rules: built on json-iterator/go like
+// Prometheus's own API uses for the same reason, it decodes
+// data.groups[*].rules[*] one element at a time, applies the same tenant
+// and query-param filtering as routes.rules, and writes only the kept
+// elements to the response body without ever holding the full filtered
+// slice in memory. It falls back to the buffered modifier below
+// streamingThreshold.
+func streamingRulesModifier(r *routes) func(*http.Response) error {
+	buffered := apiResponseModifier(func(apir *apiResponse) error {
+		return r.rules(apir)
+	})
+
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return buffered(resp)
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength < streamingThreshold {
+			return buffered(resp)
+		}
+
+		lvalue := mustLabelValue(resp.Request.Context())
+		filter := newRulesFilter(resp.Request.URL.Query())
+
+		keepGroup := func(rg *ruleGroup) bool {
+			return filter.matchesRuleGroup(rg)
+		}
+		// tenantRule mirrors routes.ruleBelongsToTenant: it also narrows
+		// rl.Alerts to the tenant's alerts in place, exactly as the
+		// buffered path does, so a kept alerting rule never leaks
+		// another tenant's generated alerts. queryRule applies the
+		// chunk0-2 type/rule_name[] filter on top of that, mirroring the
+		// order routes.rules applies them in.
+		tenantRule := func(rl rule) bool {
+			return r.ruleBelongsToTenant(rl, lvalue)
+		}
+		queryRule := func(rl rule) bool {
+			return filter.matchesRule(rl)
+		}
+
+		defer resp.Body.Close()
+
+		var buf bytes.Buffer
+		hiddenByTenant, err := streamRules(resp.Body, &buf, keepGroup, tenantRule, queryRule)
+		if err != nil {
+			responseModifierErrorsTotal.Inc()
+			return errors.Wrap(err, "can't stream rules response")
+		}
+		if hiddenByTenant > 0 {
+			warningsInjectedTotal.Inc()
+		}
+
+		resp.Body = ioutil.NopCloser(&buf)
+		resp.Header["Content-Length"] = []string{fmt.Sprint(buf.Len())}
+
+		return nil
+	}
+}
+
+// streamRules streams the top-level {"status","data":<stream>,"warnings"}
+// envelope of a successful /api/v1/rules response from r to w, decoding and
+// filtering data.groups[*].rules[*] one group at a time. It returns the
+// number of rule groups dropped by the tenant-label filter specifically
+// (as opposed to keepGroup/queryRule, the caller's own query-param
+// filters), which is folded into a "hidden by label enforcement" warning —
+// the same distinction routes.rules makes.
+func streamRules(r io.Reader, w io.Writer, keepGroup func(*ruleGroup) bool, tenantRule, queryRule func(rule) bool) (int, error) {
+	iter := jsoniter.Parse(jsoniter.ConfigDefault, r, 64*1024)
+	stream := jsoniter.NewStream(jsoniter.ConfigDefault, w, 64*1024)
+
+	stream.WriteObjectStart()
+	stream.WriteObjectField("status")
+	stream.WriteString("success")
+
+	var warnings []string
+	var hiddenByTenant int
+
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		switch field {
+		case "data":
+			stream.WriteMore()
+			stream.WriteObjectField("data")
+
+			var err error
+			_, hiddenByTenant, err = streamRulesData(iter, stream, keepGroup, tenantRule, queryRule)
+			if err != nil {
+				return hiddenByTenant, err
+			}
+		case "warnings":
+			iter.ReadVal(&warnings)
+		default:
+			iter.Skip()
+		}
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return hiddenByTenant, iter.Error
+	}
+
+	if hiddenByTenant > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d rule groups hidden by label enforcement", hiddenByTenant))
+	}
+	if len(warnings) > 0 {
+		stream.WriteMore()
+		stream.WriteObjectField("warnings")
+		stream.WriteVal(warnings)
+	}
+	stream.WriteObjectEnd()
+
+	return hiddenByTenant, stream.Flush()
+}
+
+func streamRulesData(iter *jsoniter.Iterator, stream *jsoniter.Stream, keepGroup func(*ruleGroup) bool, tenantRule, queryRule func(rule) bool) (total, hiddenByTenant int, err error) {
+	stream.WriteObjectStart()
+	stream.WriteObjectField("groups")
+	stream.WriteArrayStart()
+
+	first := true
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		if field != "groups" {
+			iter.Skip()
+			continue
+		}
+		for iter.ReadArray() {
+			total++
+			_, hiddenGroup, err := streamRuleGroup(iter, stream, &first, keepGroup, tenantRule, queryRule)
+			if err != nil {
+				return total, hiddenByTenant, err
+			}
+			if hiddenGroup {
+				hiddenByTenant++
+			}
+		}
+	}
+
+	stream.WriteArrayEnd()
+	stream.WriteObjectEnd()
+
+	return total, hiddenByTenant, iter.Error
+}
+
+// streamRuleGroup decodes a single rule group, filtering its rules one at a
+// time — first by tenantRule, then by queryRule — and writes it to stream
+// only if keepGroup accepts it and at least one rule survived both.
+// Rules are decoded and re-encoded one by one so that only the kept subset
+// of one group, never the whole response, is held in memory at a time.
+//
+// It reports whether the group was written, and separately whether it was
+// dropped because no rule belonged to the tenant at all (as opposed to
+// being dropped, or trimmed down, by the caller's own query-param filters).
+func streamRuleGroup(iter *jsoniter.Iterator, stream *jsoniter.Stream, first *bool, keepGroup func(*ruleGroup) bool, tenantRule, queryRule func(rule) bool) (kept bool, hiddenByTenant bool, err error) {
+	rg := &ruleGroup{}
+
+	var rulesBuf bytes.Buffer
+	ruleStream := jsoniter.NewStream(jsoniter.ConfigDefault, &rulesBuf, 4096)
+	ruleStream.WriteArrayStart()
+	firstRule := true
+	tenantMatched := 0
+	queryMatched := 0
+
+	for field := iter.ReadObject(); field != ""; field = iter.ReadObject() {
+		switch field {
+		case "name":
+			rg.Name = iter.ReadString()
+		case "file":
+			rg.File = iter.ReadString()
+		case "interval":
+			rg.Interval = iter.ReadFloat64()
+		case "rules":
+			for iter.ReadArray() {
+				raw := iter.SkipAndReturnBytes()
+
+				var rl rule
+				if err := json.Unmarshal(raw, &rl); err != nil {
+					return false, false, errors.Wrap(err, "can't decode rule")
+				}
+				// tenantRule narrows rl.alertingRule.Alerts to the
+				// tenant's alerts in place, so it must run before rl is
+				// re-encoded below.
+				if !tenantRule(rl) {
+					continue
+				}
+				tenantMatched++
+
+				if !queryRule(rl) {
+					continue
+				}
+
+				data, err := json.Marshal(&rl)
+				if err != nil {
+					return false, false, errors.Wrap(err, "can't encode rule")
+				}
+
+				if !firstRule {
+					ruleStream.WriteMore()
+				}
+				firstRule = false
+				ruleStream.WriteRaw(string(data))
+				queryMatched++
+			}
+		default:
+			iter.Skip()
+		}
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		return false, false, iter.Error
+	}
+
+	if tenantMatched == 0 {
+		return false, true, nil
+	}
+	if queryMatched == 0 || !keepGroup(rg) {
+		return false, false, nil
+	}
+
+	ruleStream.WriteArrayEnd()
+	if err := ruleStream.Flush(); err != nil {
+		return false, false, errors.Wrap(err, "can't flush filtered rules")
+	}
+
+	if !*first {
+		stream.WriteMore()
+	}
+	*first = false
+
+	stream.WriteObjectStart()
+	stream.WriteObjectField("name")
+	stream.WriteString(rg.Name)
+	stream.WriteMore()
+	stream.WriteObjectField("file")
+	stream.WriteString(rg.File)
+	stream.WriteMore()
+	stream.WriteObjectField("rules")
+	stream.WriteRaw(rulesBuf.String())
+	stream.WriteMore()
+	stream.WriteObjectField("interval")
+	stream.WriteFloat64(rg.Interval)
+	stream.WriteObjectEnd()
+
+	return true, false, nil
+}
@@ -0,0 +1,350 @@
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func syntheticRulesPayload(groups, rulesPerGroup int) []byte {
+	var rgs []*ruleGroup
+	for g := 0; g < groups; g++ {
+		var rules []rule
+		for i := 0; i < rulesPerGroup; i++ {
+			rules = append(rules, rule{
+				alertingRule: &alertingRule{
+					Name:  fmt.Sprintf("Alert%d", i),
+					Type:  "alerting",
+					Query: `up == 0`,
+					Labels: labels.Labels{
+						{Name: "namespace", Value: fmt.Sprintf("tenant-%d", i%4)},
+					},
+				},
+			})
+		}
+		rgs = append(rgs, &ruleGroup{
+			Name:  fmt.Sprintf("group-%d", g),
+			File:  fmt.Sprintf("file-%d.yaml", g),
+			Rules: rules,
+		})
+	}
+
+	b, err := json.Marshal(&apiResponse{Status: "success", Data: mustMarshal(&rulesData{RuleGroups: rgs})})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func BenchmarkRulesFilterBuffered(b *testing.B) {
+	payload := syntheticRulesPayload(2000, 5)
+	lvalue := "tenant-0"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var apir apiResponse
+		if err := json.Unmarshal(payload, &apir); err != nil {
+			b.Fatal(err)
+		}
+
+		var rgs rulesData
+		if err := json.Unmarshal(apir.Data, &rgs); err != nil {
+			b.Fatal(err)
+		}
+
+		filtered := []*ruleGroup{}
+		for _, rg := range rgs.RuleGroups {
+			var rules []rule
+			for _, rl := range rg.Rules {
+				for _, lbl := range rl.Labels() {
+					if lbl.Name == "namespace" && lbl.Value == lvalue {
+						rules = append(rules, rl)
+						break
+					}
+				}
+			}
+			if len(rules) > 0 {
+				rg.Rules = rules
+				filtered = append(filtered, rg)
+			}
+		}
+
+		apir.Data = mustMarshal(&rulesData{RuleGroups: filtered})
+		if _, err := json.Marshal(&apir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRulesFilterStreaming(b *testing.B) {
+	payload := syntheticRulesPayload(2000, 5)
+	lvalue := "tenant-0"
+
+	keepGroup := func(rg *ruleGroup) bool { return true }
+	tenantRule := func(rl rule) bool {
+		for _, lbl := range rl.Labels() {
+			if lbl.Name == "namespace" && lbl.Value == lvalue {
+				return true
+			}
+		}
+		return false
+	}
+	queryRule := func(rl rule) bool { return true }
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out bytes.Buffer
+		if _, err := streamRules(bytes.NewReader(payload), &out, keepGroup, tenantRule, queryRule); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// streamRulesForTenant builds the same keepGroup/tenantRule/queryRule
+// predicates streamingRulesModifier wires up for a request, so tests can
+// drive streamRules exactly the way production code does.
+func streamRulesForTenant(r *routes, values url.Values, lvalue string) (keepGroup func(*ruleGroup) bool, tenantRule, queryRule func(rule) bool) {
+	filter := newRulesFilter(values)
+	keepGroup = func(rg *ruleGroup) bool { return filter.matchesRuleGroup(rg) }
+	tenantRule = func(rl rule) bool { return r.ruleBelongsToTenant(rl, lvalue) }
+	queryRule = func(rl rule) bool { return filter.matchesRule(rl) }
+	return keepGroup, tenantRule, queryRule
+}
+
+// bufferedRules mirrors routes.rules's filtering logic exactly, but takes
+// lvalue directly instead of pulling it off the request context via
+// mustLabelValue, so tests can drive it for an arbitrary tenant without
+// building a request context.
+func bufferedRules(t *testing.T, r *routes, payload []byte, values url.Values, lvalue string) *apiResponse {
+	t.Helper()
+
+	var apir apiResponse
+	if err := json.Unmarshal(payload, &apir); err != nil {
+		t.Fatalf("can't decode payload: %v", err)
+	}
+	apir.ctx = context.Background()
+	apir.query = values
+
+	var rgs rulesData
+	if err := json.Unmarshal(apir.Data, &rgs); err != nil {
+		t.Fatalf("can't decode rule groups: %v", err)
+	}
+
+	filter := newRulesFilter(values)
+
+	filtered := []*ruleGroup{}
+	hiddenByTenant := 0
+	for _, rg := range rgs.RuleGroups {
+		var rules []rule
+		for _, rule := range rg.Rules {
+			if !r.ruleBelongsToTenant(rule, lvalue) {
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		if len(rules) == 0 {
+			hiddenByTenant++
+			continue
+		}
+
+		if !filter.matchesRuleGroup(rg) {
+			continue
+		}
+
+		var matched []rule
+		for _, rule := range rules {
+			if filter.matchesRule(rule) {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		rg.Rules = matched
+		filtered = append(filtered, rg)
+	}
+
+	if hiddenByTenant > 0 {
+		apir.Warnings = append(apir.Warnings, fmt.Sprintf("%d rule groups hidden by label enforcement", hiddenByTenant))
+	}
+	if err := apir.setData(&rulesData{RuleGroups: filtered}); err != nil {
+		t.Fatalf("can't set data: %v", err)
+	}
+
+	return &apir
+}
+
+func streamedRules(t *testing.T, r *routes, payload []byte, values url.Values, lvalue string) *apiResponse {
+	t.Helper()
+
+	keepGroup, tenantRule, queryRule := streamRulesForTenant(r, values, lvalue)
+
+	var out bytes.Buffer
+	if _, err := streamRules(bytes.NewReader(payload), &out, keepGroup, tenantRule, queryRule); err != nil {
+		t.Fatalf("streamRules() returned error: %v", err)
+	}
+
+	var apir apiResponse
+	if err := json.Unmarshal(out.Bytes(), &apir); err != nil {
+		t.Fatalf("can't decode streamed output: %v", err)
+	}
+	return &apir
+}
+
+func decodeRuleGroups(t *testing.T, apir *apiResponse) []*ruleGroup {
+	t.Helper()
+
+	var rgs rulesData
+	if err := json.Unmarshal(apir.Data, &rgs); err != nil {
+		t.Fatalf("can't decode rule groups: %v", err)
+	}
+	return rgs.RuleGroups
+}
+
+func multiTenantRulesPayload() []byte {
+	rgs := []*ruleGroup{
+		{
+			Name: "group-a",
+			File: "a.yaml",
+			Rules: []rule{
+				{alertingRule: &alertingRule{
+					Name: "AlertA",
+					Type: "alerting",
+					Alerts: []*alert{
+						{Labels: labels.Labels{{Name: "namespace", Value: "tenant-a"}}, State: "firing"},
+						{Labels: labels.Labels{{Name: "namespace", Value: "tenant-b"}}, State: "firing"},
+					},
+				}},
+				{recordingRule: &recordingRule{
+					Name:   "record:a",
+					Type:   "recording",
+					Labels: labels.Labels{{Name: "namespace", Value: "tenant-a"}},
+				}},
+			},
+		},
+		{
+			Name: "group-b",
+			File: "b.yaml",
+			Rules: []rule{
+				{recordingRule: &recordingRule{
+					Name:   "record:b",
+					Type:   "recording",
+					Labels: labels.Labels{{Name: "namespace", Value: "tenant-b"}},
+				}},
+			},
+		},
+	}
+
+	return mustMarshal(&apiResponse{Status: "success", Data: mustMarshal(&rulesData{RuleGroups: rgs})})
+}
+
+func TestStreamRulesTenantIsolation(t *testing.T) {
+	r := &routes{label: "namespace"}
+	payload := multiTenantRulesPayload()
+
+	apir := streamedRules(t, r, payload, url.Values{}, "tenant-a")
+	rgs := decodeRuleGroups(t, apir)
+
+	if len(rgs) != 1 {
+		t.Fatalf("expected only group-a to belong to tenant-a, got %d groups", len(rgs))
+	}
+	if rgs[0].Name != "group-a" {
+		t.Fatalf("expected group-a, got %q", rgs[0].Name)
+	}
+	if len(rgs[0].Rules) != 2 {
+		t.Fatalf("expected both of group-a's rules to belong to tenant-a, got %d", len(rgs[0].Rules))
+	}
+}
+
+func TestStreamRulesNarrowsAlertsToTenant(t *testing.T) {
+	r := &routes{label: "namespace"}
+	payload := multiTenantRulesPayload()
+
+	apir := streamedRules(t, r, payload, url.Values{}, "tenant-a")
+	rgs := decodeRuleGroups(t, apir)
+
+	var alertA *rule
+	for i, rl := range rgs[0].Rules {
+		if rl.alertingRule != nil {
+			alertA = &rgs[0].Rules[i]
+		}
+	}
+	if alertA == nil {
+		t.Fatal("expected AlertA to survive tenant filtering")
+	}
+	if len(alertA.alertingRule.Alerts) != 1 || alertA.alertingRule.Alerts[0].Labels.Get("namespace") != "tenant-a" {
+		t.Fatalf("expected Alerts to be narrowed to tenant-a's alert, got %+v", alertA.alertingRule.Alerts)
+	}
+}
+
+func TestStreamRulesHonorsQueryParams(t *testing.T) {
+	r := &routes{label: "namespace"}
+	payload := multiTenantRulesPayload()
+
+	apir := streamedRules(t, r, payload, url.Values{"type": {"alert"}}, "tenant-a")
+	rgs := decodeRuleGroups(t, apir)
+
+	if len(rgs) != 1 || len(rgs[0].Rules) != 1 || rgs[0].Rules[0].alertingRule == nil {
+		t.Fatalf("expected type=alert to leave only AlertA, got %+v", rgs)
+	}
+
+	apir = streamedRules(t, r, payload, url.Values{"rule_name[]": {"record:a"}}, "tenant-a")
+	rgs = decodeRuleGroups(t, apir)
+	if len(rgs) != 1 || len(rgs[0].Rules) != 1 || rgs[0].Rules[0].recordingRule == nil || rgs[0].Rules[0].recordingRule.Name != "record:a" {
+		t.Fatalf("expected rule_name[]=record:a to leave only record:a, got %+v", rgs)
+	}
+
+	apir = streamedRules(t, r, payload, url.Values{"file[]": {"nonexistent.yaml"}}, "tenant-a")
+	rgs = decodeRuleGroups(t, apir)
+	if len(rgs) != 0 {
+		t.Fatalf("expected file[]=nonexistent.yaml to drop every group, got %d", len(rgs))
+	}
+}
+
+func TestStreamRulesEquivalentToBuffered(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		lvalue string
+		values url.Values
+	}{
+		{"tenant-a, no filter", "tenant-a", url.Values{}},
+		{"tenant-b, no filter", "tenant-b", url.Values{}},
+		{"tenant-a, type=record", "tenant-a", url.Values{"type": {"record"}}},
+		{"tenant-a, file[]=a.yaml", "tenant-a", url.Values{"file[]": {"a.yaml"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &routes{label: "namespace"}
+			payload := multiTenantRulesPayload()
+
+			buffered := bufferedRules(t, r, payload, tc.values, tc.lvalue)
+			streamed := streamedRules(t, r, payload, tc.values, tc.lvalue)
+
+			bufferedGroups := decodeRuleGroups(t, buffered)
+			streamedGroups := decodeRuleGroups(t, streamed)
+
+			if !reflect.DeepEqual(bufferedGroups, streamedGroups) {
+				t.Fatalf("streamed output differs from buffered output:\nbuffered: %+v\nstreamed: %+v", bufferedGroups, streamedGroups)
+			}
+			if !reflect.DeepEqual(buffered.Warnings, streamed.Warnings) {
+				t.Fatalf("streamed warnings differ from buffered warnings: buffered=%v streamed=%v", buffered.Warnings, streamed.Warnings)
+			}
+		})
+	}
+}
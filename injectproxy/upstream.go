@@ -0,0 +1,29 @@
+package injectproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// selfRequestClient is used for the additional upstream calls the proxy
+// originates on its own behalf, as opposed to the ones forwarded by the
+// reverse proxy (e.g. re-fetching a silence to authorize its deletion, or
+// resolving a tenant's visible metric names). Unlike those forwarded
+// requests, these aren't bounded by the reverse proxy's own transport, so
+// they get an explicit timeout: a hung upstream must not block a handler
+// indefinitely.
+var selfRequestClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// copyRequestHeaders copies the headers of the inbound request that
+// authorized it upstream (e.g. Authorization, Cookie) onto a request the
+// proxy originates on its own behalf, so upstream authorizes it the same
+// way it authorized the original request.
+func copyRequestHeaders(dst, src *http.Request) {
+	for name, values := range src.Header {
+		for _, v := range values {
+			dst.Header.Add(name, v)
+		}
+	}
+}